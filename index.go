@@ -0,0 +1,341 @@
+package main
+
+import (
+	"bufio"
+	"encoding/gob"
+	"io"
+	"os"
+	"strings"
+	"syscall"
+)
+
+// indexEntry is the on-disk record for one directory, keyed by inode so
+// it survives being moved or renamed within the same filesystem.
+type indexEntry struct {
+	FullPath string
+	Device   uint64
+	Inode    uint64
+	Size     uint64 // recursive total, same meaning as summaryNode.size
+	Mtime    int64
+	Ctime    int64
+	Parent   uint64
+	Children []uint64
+}
+
+// diskIndex is the persisted summary tree produced by -index. fileSizes
+// caches the per-file byte counts needed to replay a +/-/M change stream
+// without re-reading the filesystem.
+type diskIndex struct {
+	Root      string
+	RootInode uint64
+	Entries   map[uint64]*indexEntry
+	fileSizes map[string]uint64
+}
+
+func newDiskIndex(root string) *diskIndex {
+	return &diskIndex{
+		Root:      root,
+		Entries:   make(map[uint64]*indexEntry),
+		fileSizes: make(map[string]uint64),
+	}
+}
+
+func loadIndex(path string) (*diskIndex, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var onDisk struct {
+		Root      string
+		RootInode uint64
+		Entries   map[uint64]*indexEntry
+		FileSizes map[string]uint64
+	}
+	if err := gob.NewDecoder(f).Decode(&onDisk); err != nil {
+		return nil, err
+	}
+	return &diskIndex{
+		Root:      onDisk.Root,
+		RootInode: onDisk.RootInode,
+		Entries:   onDisk.Entries,
+		fileSizes: onDisk.FileSizes,
+	}, nil
+}
+
+// save writes idx as a gob-encoded file, via a temp-file-then-rename so a
+// crash mid-write can't corrupt an existing index.
+func (idx *diskIndex) save(path string) error {
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	onDisk := struct {
+		Root      string
+		RootInode uint64
+		Entries   map[uint64]*indexEntry
+		FileSizes map[string]uint64
+	}{idx.Root, idx.RootInode, idx.Entries, idx.fileSizes}
+	if err := gob.NewEncoder(f).Encode(&onDisk); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// refreshEntry is one directory's bookkeeping while refreshNode is in
+// progress: discovery (Lstat, readdir) happens top-down in BFS order,
+// then totals are folded bottom-up once every child is known, the same
+// two-pass shape finalizeTotals/toSummaryNode use for the live walk so
+// neither traversal can overflow the stack on a deep tree.
+type refreshEntry struct {
+	dir       string
+	parent    uint64
+	listInode uint64 // inode as seen in the parent's own directory listing, recorded in the parent's indexEntry.Children even if this entry's own Lstat below fails
+	inode     uint64
+	mtime     int64
+	ctime     int64
+	statErr   bool
+	cached    bool
+	children  []*refreshEntry
+	result    summaryNode
+}
+
+// refreshNode walks dir, reusing idx's cached size for any directory whose
+// mtime/ctime has not moved since it was last recorded, and re-scanning
+// only the subtrees that have. On a first run against an empty index this
+// degenerates into a full scan, same as worker.
+func refreshNode(idx *diskIndex, dir string, device uint64, parent uint64) summaryNode {
+	root := &refreshEntry{dir: dir, parent: parent}
+	order := []*refreshEntry{root}
+
+	for i := 0; i < len(order); i++ {
+		n := order[i]
+		stat, err := os.Lstat(n.dir)
+		if err != nil {
+			n.statErr = true
+			continue
+		}
+		sys, ok := stat.Sys().(*syscall.Stat_t)
+		if !ok {
+			n.statErr = true
+			continue
+		}
+		n.inode = sys.Ino
+		n.mtime, n.ctime = statTimes(sys)
+
+		if entry, seen := idx.Entries[n.inode]; seen && entry.Mtime == n.mtime && entry.Ctime == n.ctime {
+			n.cached = true
+			continue
+		}
+
+		n.result = summaryNode{fullpath: n.dir, device: device}
+		for _, child := range lStats(n.dir, device) {
+			if child.Mode().IsDir() {
+				fullpath := strings.ReplaceAll(n.dir+"/"+child.Name(), "//", "/")
+				childEntry := &refreshEntry{dir: fullpath, parent: n.inode}
+				if childSys, ok := child.Sys().(*syscall.Stat_t); ok {
+					childEntry.listInode = childSys.Ino
+				}
+				n.children = append(n.children, childEntry)
+				order = append(order, childEntry)
+			} else if child.Mode().IsRegular() {
+				size := uint64(512 * child.Sys().(*syscall.Stat_t).Blocks)
+				n.result.size += size
+				n.result.uniqueSize += size // -index does not support -shared-aware; unique mirrors apparent
+				idx.fileSizes[n.dir+"/"+child.Name()] = size
+			}
+		}
+	}
+
+	for i := len(order) - 1; i >= 0; i-- {
+		n := order[i]
+		switch {
+		case n.statErr:
+			n.result = summaryNode{fullpath: n.dir}
+		case n.cached:
+			n.result = cachedTree(idx, n.inode)
+		default:
+			var childInodes []uint64
+			for _, child := range n.children {
+				n.result.appendChildNode(child.result)
+				childInodes = append(childInodes, child.listInode)
+			}
+			idx.Entries[n.inode] = &indexEntry{
+				FullPath: n.dir, Device: device, Inode: n.inode,
+				Size: n.result.size, Mtime: n.mtime, Ctime: n.ctime,
+				Parent: n.parent, Children: childInodes,
+			}
+		}
+	}
+
+	return root.result
+}
+
+// cachedTree reconstructs a summaryNode purely from the saved index, with
+// no filesystem access at all - used to answer from a change-stream
+// update. It mirrors toSummaryNode's iterative, fixed-capacity-slice
+// approach so a deeply nested index can't overflow the stack either.
+func cachedTree(idx *diskIndex, inode uint64) summaryNode {
+	entry, ok := idx.Entries[inode]
+	if !ok {
+		return summaryNode{}
+	}
+	result := summaryNode{fullpath: entry.FullPath, size: entry.Size, uniqueSize: entry.Size, device: entry.Device}
+
+	type frame struct {
+		inode uint64
+		dst   *summaryNode
+	}
+	stack := []frame{{inode, &result}}
+
+	for len(stack) > 0 {
+		f := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+
+		e := idx.Entries[f.inode]
+		qualifying := make([]uint64, 0, len(e.Children))
+		for _, childInode := range e.Children {
+			if childEntry, seen := idx.Entries[childInode]; seen && oneGB < childEntry.Size {
+				qualifying = append(qualifying, childInode)
+			}
+		}
+
+		f.dst.children = make([]summaryNode, len(qualifying))
+		for i, childInode := range qualifying {
+			childEntry := idx.Entries[childInode]
+			f.dst.children[i] = summaryNode{fullpath: childEntry.FullPath, size: childEntry.Size, uniqueSize: childEntry.Size, device: childEntry.Device}
+			stack = append(stack, frame{childInode, &f.dst.children[i]})
+		}
+	}
+
+	return result
+}
+
+// applyChangeStream reads lines in the "+PATH" (created), "-PATH" (removed)
+// and "MPATH" (modified) format that zfs diff / btrfs send emit, and folds
+// each one into idx's cached sizes without walking the filesystem.
+func applyChangeStream(idx *diskIndex, r io.Reader, device uint64) {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if len(line) < 2 {
+			continue
+		}
+		switch line[0] {
+		case '+', 'M':
+			applyPathChange(idx, line[1:], device)
+		case '-':
+			applyPathRemoval(idx, line[1:], device)
+		}
+	}
+}
+
+func applyPathChange(idx *diskIndex, path string, device uint64) {
+	stat, err := os.Lstat(path)
+	if err != nil {
+		applyPathRemoval(idx, path, device)
+		return
+	}
+	if !stat.Mode().IsRegular() {
+		return
+	}
+	sys, ok := stat.Sys().(*syscall.Stat_t)
+	if !ok {
+		return
+	}
+	newSize := uint64(512 * sys.Blocks)
+	delta := int64(newSize) - int64(idx.fileSizes[path])
+	idx.fileSizes[path] = newSize
+	propagateDelta(idx, path, delta, device)
+}
+
+func applyPathRemoval(idx *diskIndex, path string, device uint64) {
+	oldSize, known := idx.fileSizes[path]
+	if !known {
+		return
+	}
+	delete(idx.fileSizes, path)
+	propagateDelta(idx, path, -int64(oldSize), device)
+}
+
+// propagateDelta walks path's ancestor chain up to and including idx.Root,
+// adjusting each cached directory's recursive size by delta. A slash at
+// index 0 (dir == "/something") means the next ancestor is "/" itself,
+// which must still be visited rather than treated as "no more slashes" -
+// otherwise a -index / run never updates the root entry that
+// cachedTree(idx, idx.RootInode) reports from.
+func propagateDelta(idx *diskIndex, path string, delta int64, device uint64) {
+	if delta == 0 {
+		return
+	}
+	dir := path
+	for dir != idx.Root {
+		slash := strings.LastIndex(dir, "/")
+		switch {
+		case slash > 0:
+			dir = dir[:slash]
+		case slash == 0:
+			dir = "/"
+		default:
+			return
+		}
+
+		stat, err := os.Lstat(dir)
+		if err != nil {
+			continue
+		}
+		sys, ok := stat.Sys().(*syscall.Stat_t)
+		if !ok {
+			continue
+		}
+		entry, seen := idx.Entries[sys.Ino]
+		if !seen {
+			mtime, ctime := statTimes(sys)
+			entry = &indexEntry{FullPath: dir, Device: device, Inode: sys.Ino, Mtime: mtime, Ctime: ctime}
+			idx.Entries[sys.Ino] = entry
+		}
+		entry.Size = uint64(int64(entry.Size) + delta)
+	}
+}
+
+// runIndexed loads (or creates, or rebuilds) the index at path. If stdin
+// is a pipe, it is read as a change stream and applied with no walk at
+// all; otherwise the tree is refreshed incrementally from the filesystem.
+func runIndexed(path, dir string, device uint64, rebuild bool) (summaryNode, *diskIndex) {
+	var idx *diskIndex
+	if !rebuild {
+		if loaded, err := loadIndex(path); err == nil {
+			idx = loaded
+		}
+	}
+	if idx == nil {
+		idx = newDiskIndex(dir)
+	}
+
+	if !rebuild && stdinIsPipe() {
+		applyChangeStream(idx, os.Stdin, device)
+		return cachedTree(idx, idx.RootInode), idx
+	}
+
+	root := refreshNode(idx, dir, device, 0)
+	if stat, err := os.Lstat(dir); err == nil {
+		if sys, ok := stat.Sys().(*syscall.Stat_t); ok {
+			idx.RootInode = sys.Ino
+		}
+	}
+	return root, idx
+}
+
+func stdinIsPipe() bool {
+	stat, err := os.Stdin.Stat()
+	if err != nil {
+		return false
+	}
+	return (stat.Mode() & os.ModeCharDevice) == 0
+}
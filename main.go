@@ -4,23 +4,37 @@
 
  Report back list of large directories with size larger than 4G.
 
- Note that this purposely does not cross file systems, so using
+ Note that this by default does not cross file systems, so using
  'bdb /' will report on the root file system, not everything under its
- directory structure.  Likewise, bdb purposely avoids symlinks.
+ directory structure; pass -cross to descend into child mounts instead.
+ Likewise, bdb purposely avoids symlinks.
+
+ The walk is driven from an explicit work queue rather than recursion,
+ so it does not run out of stack on pathologically deep trees, and
+ Ctrl-C reports whatever partial results have been gathered so far.
 
  options:
     -threads N  (number of threads, default 4)
     -size N (minimum GB of interest, default 1)
+    -index PATH (persist the summary tree to PATH, refresh incrementally)
+    -rebuild (force a full re-scan when used with -index)
+    -max-open-dirs N (cap on concurrently open directory fds, default 256)
+    -format FORMAT (human, json, ndjson, or csv; default human)
+    -cross (descend into child mounts, with a header line at each one)
+    -shared-aware (on btrfs, count reflinked/CoW-shared extents once)
+    -cross-subvol (used with -shared-aware; descend into subvolumes too)
 
 **********************************************************************/
 
 package main
 
+import "context"
 import "fmt"
+import "io"
 import "log"
 import "os"
+import "os/signal"
 import "syscall"
-import "strings"
 import "flag"
 import "sort"
 
@@ -65,69 +79,65 @@ func lStats(dir string, device uint64) []os.FileInfo {
 }
 
 type summaryNode struct {
-	size     uint64
-	fullpath string
-	children []summaryNode
+	size       uint64 // apparent bytes, Stat_t.Blocks*512
+	uniqueSize uint64 // apparent bytes minus extents already counted elsewhere in the walk
+	device     uint64
+	fullpath   string
+	children   []summaryNode
 }
 
 func (node *summaryNode) appendChildNode(child summaryNode) {
 	node.size += child.size
+	node.uniqueSize += child.uniqueSize
 	if oneGB < child.size {
 		node.children = append(node.children, child)
 	}
 }
 
-func (node *summaryNode) dump(minSize uint64, collapsed bool) {
+// dump prints the human report. showUnique adds a second, "unique bytes"
+// column - meaningful only once -shared-aware has actually deduplicated
+// shared extents, since otherwise it always equals the first column.
+func (node *summaryNode) dump(w io.Writer, minSize uint64, collapsed, showUnique bool) {
 	sort.Slice(node.children, func(i, j int) bool { return node.children[i].size > node.children[j].size })
 	if node.size >= minSize {
-		size := float64(node.size)
-		fmt.Printf("%s %.1f\n", node.fullpath, (size / oneGB))
-		if collapsed && len(node.children) == 1 && node.children[0].size >= minSize {
-			for len(node.children) == 1 && node.children[0].size >= minSize {
+		if showUnique {
+			fmt.Fprintf(w, "%s %.1f %.1f\n", node.fullpath, float64(node.size)/oneGB, float64(node.uniqueSize)/oneGB)
+		} else {
+			fmt.Fprintf(w, "%s %.1f\n", node.fullpath, float64(node.size)/oneGB)
+		}
+		collapsible := func() bool {
+			return collapsed && len(node.children) == 1 &&
+				node.children[0].size >= minSize && node.children[0].device == node.device
+		}
+		if collapsible() {
+			for collapsible() {
 				node = &node.children[0]
 			}
-			node.dump(minSize, collapsed)
+			node.dump(w, minSize, collapsed, showUnique)
 		} else {
-			for _, child := range node.children {
-				child.dump(minSize, collapsed)
+			for i := range node.children {
+				child := &node.children[i]
+				if child.device != node.device {
+					printMountHeader(w, child.device)
+				}
+				child.dump(w, minSize, collapsed, showUnique)
 			}
 		}
 	}
 }
 
-func worker(dir string, device uint64) summaryNode {
-
-	result := summaryNode{fullpath: dir}
-
-	for _, stat := range lStats(dir, device) {
-		mode := stat.Mode()
-		if mode.IsDir() {
-			fullpath := strings.ReplaceAll(dir+"/"+stat.Name(), "//", "/")
-			result.appendChildNode(worker(fullpath, device))
-		} else if mode.IsRegular() {
-			blocks := uint64(stat.Sys().(*syscall.Stat_t).Blocks)
-			result.size += uint64(512 * blocks)
-		}
-	}
-
-	return result
-}
-
-func workerThread(device uint64, dirJobs <-chan string, summary chan<- summaryNode, completed chan<- bool) {
-	for dir := range dirJobs {
-		child := worker(dir, device)
-		if child.size > 0 {
-			summary <- child
-		}
-	}
-	completed <- true
-}
-
 func main() {
 
 	threadsPtr := flag.Int("threads", 4, "number of threads (4 appropriate for SSD, 1 for magnetic disk)")
 	sizePtr := flag.Uint64("size", 1, "minimum reportable size in GBs")
 	noElisionPtr := flag.Bool("no-elision", false, "full display of repetitive directory traversal")
+	indexPtr := flag.String("index", "", "path to a persistent index database; scans become incremental")
+	rebuildPtr := flag.Bool("rebuild", false, "force a full re-scan when used with -index")
+	maxOpenDirsPtr := flag.Int("max-open-dirs", 256, "maximum directory file descriptors open at once")
+	formatPtr := flag.String("format", "human", "output format: human, json, ndjson, or csv")
+	crossPtr := flag.Bool("cross", false, "descend into child mounts instead of stopping at filesystem boundaries")
+	sharedAwarePtr := flag.Bool("shared-aware", false, "on btrfs, count reflinked/CoW-shared extents once via FIEMAP")
+	crossSubvolPtr := flag.Bool("cross-subvol", false, "used with -shared-aware; descend into subvolumes instead of stopping at them")
 
 	flag.Parse()
 
@@ -136,6 +146,15 @@ func main() {
 		return
 	}
 
+	reporter, ok := reporters[*formatPtr]
+	if !ok {
+		log.Fatal("unknown -format: " + *formatPtr)
+	}
+	if hr, isHuman := reporter.(humanReporter); isHuman {
+		hr.sharedAware = *sharedAwarePtr
+		reporter = hr
+	}
+
 	dir := flag.Arg(0)
 	dev, ok := deviceNumber(dir)
 	if !ok {
@@ -146,45 +165,41 @@ func main() {
 	minimumReportableSize := *sizePtr * oneGB
 	collapsed := !(*noElisionPtr)
 
-	dirJobs := make(chan string, threads)
-	summary := make(chan summaryNode, threads)
-	completed := make(chan bool)
-
-	for i := 0; i < threads; i++ {
-		go workerThread(dev, dirJobs, summary, completed)
-	}
-
-	dirs := make([]string, 0)
-
-	result := summaryNode{fullpath: dir}
-
-	for _, stat := range lStats(dir, dev) {
-
-		if stat.Mode().IsRegular() {
-			result.size += uint64(stat.Size())
-
-		} else if stat.Mode().IsDir() {
-			fullpath := strings.ReplaceAll(dir+"/"+stat.Name(), "//", "/")
-			dirs = append(dirs, fullpath)
+	if *indexPtr != "" {
+		root, idx := runIndexed(*indexPtr, dir, dev, *rebuildPtr)
+		if err := reporter.Report(os.Stdout, &root, minimumReportableSize, collapsed); err != nil {
+			log.Fatal("failed to write report: " + err.Error())
+		}
+		if err := idx.save(*indexPtr); err != nil {
+			log.Fatal("failed to save index: " + err.Error())
 		}
+		return
 	}
 
-	go func() {
-		for _, dir := range dirs {
-			dirJobs <- dir
-		}
-		close(dirJobs)
-	}()
-
-	for threads > 0 {
-		select {
-		case <-completed:
-			threads--
-		case child := <-summary:
-			result.appendChildNode(child)
-		}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	// ndjson streams its own output as the walk discovers each node's
+	// total, rather than waiting for Report to run over the finished
+	// tree, so pipelines see output within seconds on a large filesystem.
+	// -shared-aware can't join that: a shared extent's owner only
+	// settles once the whole walk has seen every reference to it, so a
+	// node's unique_bytes isn't known until resolve() runs at the very
+	// end - streaming it early would mean emitting a number that later
+	// turns out to be wrong.
+	_, isNdjson := reporter.(ndjsonReporter)
+	streaming := isNdjson && !*sharedAwarePtr
+	var emit func(*node)
+	if streaming {
+		emit = ndjsonEmitter(os.Stdout, minimumReportableSize)
 	}
 
+	result := walkTree(ctx, dir, dev, threads, *maxOpenDirsPtr, *crossPtr, *sharedAwarePtr, *crossSubvolPtr, emit)
 
-	result.dump(minimumReportableSize, collapsed)
+	if streaming {
+		return
+	}
+	if err := reporter.Report(os.Stdout, &result, minimumReportableSize, collapsed); err != nil {
+		log.Fatal("failed to write report: " + err.Error())
+	}
 }
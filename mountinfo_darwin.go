@@ -0,0 +1,52 @@
+//go:build darwin
+
+package main
+
+import "syscall"
+
+// MNT_NOWAIT from <sys/mount.h> - not exposed by the syscall package,
+// and asking Getfsstat to use cached statfs data instead of forcing a
+// metadata refresh per filesystem is exactly what we want here.
+const mntNoWait = 2
+
+// cCharsToString trims a NUL-terminated C char array (as darwin's
+// Statfs_t embeds Mntonname/Fstypename) down to a Go string.
+func cCharsToString(chars []int8) string {
+	n := 0
+	for n < len(chars) && chars[n] != 0 {
+		n++
+	}
+	buf := make([]byte, n)
+	for i := 0; i < n; i++ {
+		buf[i] = byte(chars[i])
+	}
+	return string(buf)
+}
+
+// lookupMount resolves an st_dev value to its mountpoint, filesystem
+// type, and capacity, via getfsstat - darwin's Statfs_t already carries
+// all of this, it's just a matter of finding the matching entry.
+func lookupMount(device uint64) (mountpoint, fstype string, total, used, free uint64, ok bool) {
+	n, err := syscall.Getfsstat(nil, mntNoWait)
+	if err != nil || n <= 0 {
+		return "", "", 0, 0, 0, false
+	}
+	stats := make([]syscall.Statfs_t, n)
+	if _, err := syscall.Getfsstat(stats, mntNoWait); err != nil {
+		return "", "", 0, 0, 0, false
+	}
+
+	for _, sfs := range stats {
+		mnt := cCharsToString(sfs.Mntonname[:])
+		var st syscall.Stat_t
+		if err := syscall.Stat(mnt, &st); err != nil || uint64(st.Dev) != device {
+			continue
+		}
+		blockSize := uint64(sfs.Bsize)
+		total = blockSize * sfs.Blocks
+		free = blockSize * sfs.Bfree
+		used = total - blockSize*sfs.Bavail
+		return mnt, cCharsToString(sfs.Fstypename[:]), total, used, free, true
+	}
+	return "", "", 0, 0, 0, false
+}
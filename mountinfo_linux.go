@@ -0,0 +1,91 @@
+//go:build linux
+
+package main
+
+import (
+	"bufio"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// mountEntry is the subset of a /proc/self/mountinfo line lookupMount
+// needs: where it's mounted and what kind of filesystem it is.
+type mountEntry struct {
+	mountpoint string
+	fstype     string
+}
+
+// mountTable reads /proc/self/mountinfo and returns every mount keyed by
+// its st_dev, so lookupMount can answer from an inode's Dev field alone.
+// See proc(5) for the mountinfo line format; the " - " field separates
+// the per-mount fields from the fstype/source/superblock-options triple.
+func mountTable() map[uint64]mountEntry {
+	table := make(map[uint64]mountEntry)
+
+	f, err := os.Open("/proc/self/mountinfo")
+	if err != nil {
+		return table
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 7 {
+			continue
+		}
+		sep := -1
+		for i, field := range fields {
+			if field == "-" {
+				sep = i
+				break
+			}
+		}
+		if sep < 0 || sep+1 >= len(fields) {
+			continue
+		}
+
+		majMin := strings.SplitN(fields[2], ":", 2)
+		if len(majMin) != 2 {
+			continue
+		}
+		major, err1 := strconv.ParseUint(majMin[0], 10, 32)
+		minor, err2 := strconv.ParseUint(majMin[1], 10, 32)
+		if err1 != nil || err2 != nil {
+			continue
+		}
+
+		table[makedev(major, minor)] = mountEntry{mountpoint: fields[4], fstype: fields[sep+1]}
+	}
+	return table
+}
+
+// makedev matches glibc's gnu_dev_makedev, which is how the kernel
+// packs major/minor into the 64-bit st_dev that os.FileInfo reports.
+func makedev(major, minor uint64) uint64 {
+	return ((major & 0xfffff000) << 32) |
+		((major & 0x00000fff) << 8) |
+		((minor & 0xffffff00) << 12) |
+		(minor & 0x000000ff)
+}
+
+// lookupMount resolves an st_dev value to its mountpoint, filesystem
+// type, and capacity, via /proc/self/mountinfo plus statfs.
+func lookupMount(device uint64) (mountpoint, fstype string, total, used, free uint64, ok bool) {
+	entry, found := mountTable()[device]
+	if !found {
+		return "", "", 0, 0, 0, false
+	}
+
+	var sfs syscall.Statfs_t
+	if err := syscall.Statfs(entry.mountpoint, &sfs); err != nil {
+		return entry.mountpoint, entry.fstype, 0, 0, 0, true
+	}
+	blockSize := uint64(sfs.Bsize)
+	total = blockSize * sfs.Blocks
+	free = blockSize * sfs.Bfree
+	used = total - blockSize*sfs.Bavail
+	return entry.mountpoint, entry.fstype, total, used, free, true
+}
@@ -0,0 +1,19 @@
+package main
+
+import (
+	"fmt"
+	"io"
+)
+
+// printMountHeader writes a one-line banner identifying the filesystem a
+// -cross walk has just stepped onto, so mount transitions stay visible
+// in the human report instead of looking like an ordinary subdirectory.
+func printMountHeader(w io.Writer, device uint64) {
+	mountpoint, fstype, total, used, free, ok := lookupMount(device)
+	if !ok {
+		fmt.Fprintf(w, "-- device %d --\n", device)
+		return
+	}
+	fmt.Fprintf(w, "-- %s (%s) %.1fG total, %.1fG used, %.1fG free --\n",
+		mountpoint, fstype, float64(total)/oneGB, float64(used)/oneGB, float64(free)/oneGB)
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"sync"
+)
+
+// Reporter renders a completed walk. minSize/collapsed carry the same
+// meaning as summaryNode.dump. Every record carries its own node's
+// device, so a -cross walk spanning several filesystems can still be
+// grouped or filtered downstream (jq, DuckDB, a Prometheus textfile
+// exporter) without a separate lookup.
+type Reporter interface {
+	Report(w io.Writer, root *summaryNode, minSize uint64, collapsed bool) error
+}
+
+// reporters is the -format registry.
+var reporters = map[string]Reporter{
+	"human":  humanReporter{},
+	"json":   jsonReporter{},
+	"ndjson": ndjsonReporter{},
+	"csv":    csvReporter{},
+}
+
+// reportRecord is the flattened per-directory view shared by the
+// ndjson and csv reporters. Elided mirrors the chain-compression dump()
+// applies in human mode: true when this node has exactly one child, on
+// the same device, that itself clears minSize - i.e. a human report
+// would collapse straight through it rather than stopping to print it.
+type reportRecord struct {
+	Path        string `json:"path"`
+	Bytes       uint64 `json:"bytes"`
+	UniqueBytes uint64 `json:"unique_bytes"`
+	Blocks      uint64 `json:"blocks"`
+	Device      uint64 `json:"device"`
+	Depth       int    `json:"depth"`
+	ChildCount  int    `json:"child_count"`
+	Elided      bool   `json:"elided"`
+}
+
+// collectRecords flattens root into a preorder slice of records, only
+// descending into subtrees that clear minSize - the same visibility
+// rule summaryNode.dump applies. It is iterative so a pathologically
+// deep tree can't overflow the stack. elided matches dump()'s collapse
+// condition, including that a device change always breaks the chain.
+func collectRecords(root *summaryNode, minSize uint64) []reportRecord {
+	var records []reportRecord
+	if root.size < minSize {
+		return records
+	}
+
+	type frame struct {
+		node  *summaryNode
+		depth int
+	}
+	stack := []frame{{root, 0}}
+	for len(stack) > 0 {
+		f := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+
+		records = append(records, reportRecord{
+			Path:        f.node.fullpath,
+			Bytes:       f.node.size,
+			UniqueBytes: f.node.uniqueSize,
+			Blocks:      f.node.size / 512,
+			Device:      f.node.device,
+			Depth:       f.depth,
+			ChildCount:  len(f.node.children),
+			Elided:      elided(f.node, minSize),
+		})
+
+		for i := range f.node.children {
+			if f.node.children[i].size >= minSize {
+				stack = append(stack, frame{&f.node.children[i], f.depth + 1})
+			}
+		}
+	}
+	return records
+}
+
+// humanReporter is the default, du-like tree report. sharedAware adds a
+// second "unique bytes" column once -shared-aware has actually
+// deduplicated shared extents; main sets it via a type assertion after
+// looking up -format in the registry.
+type humanReporter struct {
+	sharedAware bool
+}
+
+func (hr humanReporter) Report(w io.Writer, root *summaryNode, minSize uint64, collapsed bool) error {
+	root.dump(w, minSize, collapsed, hr.sharedAware)
+	return nil
+}
+
+// ndjsonReporter writes one JSON object per directory from an already-
+// complete tree. main only calls this for -index, which never has a live
+// walk to stream from; for a direct walk it uses ndjsonEmitter instead,
+// so ndjson output doesn't wait for the whole scan to finish.
+type ndjsonReporter struct{}
+
+func (ndjsonReporter) Report(w io.Writer, root *summaryNode, minSize uint64, collapsed bool) error {
+	enc := json.NewEncoder(w)
+	for _, rec := range collectRecords(root, minSize) {
+		if err := enc.Encode(rec); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ndjsonEmitter returns a walkTree emit callback that writes one
+// reportRecord per node directly to w the moment that node's whole
+// subtree finishes - not just once at the very end - so a pipeline
+// consuming ndjson output can start before the rest of the walk is done.
+// Subtrees smaller than minSize are skipped, the same visibility rule
+// collectRecords applies to the non-streaming formats. encode errors
+// (almost always a broken pipe) are fatal, matching how main treats a
+// failed Report.
+func ndjsonEmitter(w io.Writer, minSize uint64) func(*node) {
+	enc := json.NewEncoder(w)
+	var mu sync.Mutex
+	return func(n *node) {
+		if n.total < minSize {
+			return
+		}
+		qualifying := qualifyingChildren(n)
+		rec := reportRecord{
+			Path:        n.fullpath,
+			Bytes:       n.total,
+			UniqueBytes: n.totalUnique,
+			Blocks:      n.total / 512,
+			Device:      n.device,
+			Depth:       n.depth,
+			ChildCount:  len(qualifying),
+			Elided:      len(qualifying) == 1 && qualifying[0].device == n.device && qualifying[0].total >= minSize,
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		if err := enc.Encode(rec); err != nil {
+			log.Fatal("failed to write report: " + err.Error())
+		}
+	}
+}
+
+type csvReporter struct{}
+
+func (csvReporter) Report(w io.Writer, root *summaryNode, minSize uint64, collapsed bool) error {
+	out := csv.NewWriter(w)
+	defer out.Flush()
+
+	if err := out.Write([]string{"path", "bytes", "unique_bytes", "blocks", "device", "depth", "child_count", "elided"}); err != nil {
+		return err
+	}
+	for _, rec := range collectRecords(root, minSize) {
+		row := []string{
+			rec.Path,
+			fmt.Sprint(rec.Bytes),
+			fmt.Sprint(rec.UniqueBytes),
+			fmt.Sprint(rec.Blocks),
+			fmt.Sprint(rec.Device),
+			fmt.Sprint(rec.Depth),
+			fmt.Sprint(rec.ChildCount),
+			fmt.Sprint(rec.Elided),
+		}
+		if err := out.Write(row); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// jsonNode is the nested document jsonReporter emits: the whole tree in
+// one shot, as opposed to ndjson's one-record-per-line stream.
+type jsonNode struct {
+	Path        string     `json:"path"`
+	Bytes       uint64     `json:"bytes"`
+	UniqueBytes uint64     `json:"unique_bytes"`
+	Blocks      uint64     `json:"blocks"`
+	Device      uint64     `json:"device"`
+	Depth       int        `json:"depth"`
+	ChildCount  int        `json:"child_count"`
+	Elided      bool       `json:"elided"`
+	Children    []jsonNode `json:"children,omitempty"`
+}
+
+type jsonReporter struct{}
+
+func (jsonReporter) Report(w io.Writer, root *summaryNode, minSize uint64, collapsed bool) error {
+	tree := buildJSONTree(root, minSize)
+	if tree == nil {
+		tree = &jsonNode{}
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(tree)
+}
+
+func elided(node *summaryNode, minSize uint64) bool {
+	return len(node.children) == 1 && node.children[0].device == node.device && node.children[0].size >= minSize
+}
+
+// buildJSONTree mirrors toSummaryNode's iterative, fixed-capacity-slice
+// approach so converting a deep tree can't overflow the stack or
+// invalidate a child pointer via a mid-loop slice reallocation.
+func buildJSONTree(root *summaryNode, minSize uint64) *jsonNode {
+	if root.size < minSize {
+		return nil
+	}
+
+	out := &jsonNode{
+		Path: root.fullpath, Bytes: root.size, UniqueBytes: root.uniqueSize, Blocks: root.size / 512,
+		Device: root.device, Depth: 0, ChildCount: len(root.children), Elided: elided(root, minSize),
+	}
+
+	type frame struct {
+		src   *summaryNode
+		dst   *jsonNode
+		depth int
+	}
+	stack := []frame{{root, out, 0}}
+
+	for len(stack) > 0 {
+		f := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+
+		qualifying := make([]*summaryNode, 0, len(f.src.children))
+		for i := range f.src.children {
+			if f.src.children[i].size >= minSize {
+				qualifying = append(qualifying, &f.src.children[i])
+			}
+		}
+
+		f.dst.Children = make([]jsonNode, len(qualifying))
+		for i, child := range qualifying {
+			f.dst.Children[i] = jsonNode{
+				Path: child.fullpath, Bytes: child.size, UniqueBytes: child.uniqueSize, Blocks: child.size / 512,
+				Device: child.device, Depth: f.depth + 1, ChildCount: len(child.children), Elided: elided(child, minSize),
+			}
+			stack = append(stack, frame{child, &f.dst.Children[i], f.depth + 1})
+		}
+	}
+
+	return out
+}
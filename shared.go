@@ -0,0 +1,111 @@
+package main
+
+import "sync"
+
+// fileExtent is one physical extent backing a regular file, as reported
+// by FS_IOC_FIEMAP. length is the extent's logical (decompressed) size;
+// for an encoded extent that can exceed what it actually costs on disk,
+// which is why accountFile clamps its total rather than trusting length
+// outright.
+type fileExtent struct {
+	physical uint64
+	length   uint64
+	encoded  bool
+}
+
+// extentKey identifies a physical extent uniquely (per device) so two
+// files that reflink the same bytes - or two reflinks within the same
+// file - are only counted once.
+type extentKey struct {
+	device   uint64
+	physical uint64
+}
+
+// extentTracker records, for every physical extent seen anywhere in the
+// walk, the lowest directory node common to every file discovered so far
+// that references it - its "owner". A directory's unique-bytes figure is
+// only the bytes truly reclaimable by deleting it when an extent shared
+// by two sibling subtrees is charged to neither sibling but to their
+// common ancestor instead; charging it to whichever file the walk
+// happens to visit first (the previous scheme) would make the sibling
+// that loses the race report bytes it does not actually own. The owner
+// can only climb toward the root as more references turn up, so actual
+// attribution happens once in resolve(), after the walk has seen
+// everything there is to see. The zero value is not usable; use
+// newExtentTracker.
+type extentTracker struct {
+	mu     sync.Mutex
+	owner  map[extentKey]*node
+	length map[extentKey]uint64
+}
+
+func newExtentTracker() *extentTracker {
+	return &extentTracker{owner: make(map[extentKey]*node), length: make(map[extentKey]uint64)}
+}
+
+// accountFile registers path's extents as referenced from dir - the
+// node for the directory containing path - narrowing each extent's
+// eventual owner toward the lowest common ancestor of every node that
+// has referenced it so far. It does not return a byte count: unlike the
+// non-shared-aware case, a shared-aware directory's unique bytes aren't
+// known until resolve() runs after the whole walk completes. When
+// FIEMAP isn't available for path (not btrfs, not a regular file, older
+// kernel, non-Linux) there is nothing to register.
+//
+// fe_length is logical, not physical: for an encoded (compressed)
+// extent it can run past what the extent actually occupies on disk, and
+// two references to the same extent occasionally disagree on it. Taking
+// the smallest length seen for a given extent is a conservative stand-in
+// for its true on-disk cost absent a btrfs TREE_SEARCH_V2 query.
+func (t *extentTracker) accountFile(path string, device uint64, dir *node) {
+	extents, ok := fileExtents(path)
+	if !ok {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for _, ext := range extents {
+		key := extentKey{device: device, physical: ext.physical}
+		if owner, seen := t.owner[key]; seen {
+			t.owner[key] = lowestCommonAncestor(owner, dir)
+			if ext.length < t.length[key] {
+				t.length[key] = ext.length
+			}
+		} else {
+			t.owner[key] = dir
+			t.length[key] = ext.length
+		}
+	}
+}
+
+// resolve credits every tracked extent's (deduplicated) length to its
+// settled owner's ownBytes-sibling ownUnique field, exactly once. Must
+// run after the walk has finished discovering every file - and so every
+// reference to every extent - but before the bottom-up total pass, the
+// same ordering walkTree already uses for finalizeTotals.
+func (t *extentTracker) resolve() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for key, owner := range t.owner {
+		owner.ownUnique += t.length[key]
+	}
+}
+
+// lowestCommonAncestor returns the deepest node that is an ancestor of
+// both a and b (ancestor-of-itself included), walking up via node.parent
+// using node.depth to first bring both to the same depth.
+func lowestCommonAncestor(a, b *node) *node {
+	for a.depth > b.depth {
+		a = a.parent
+	}
+	for b.depth > a.depth {
+		b = b.parent
+	}
+	for a != b {
+		a = a.parent
+		b = b.parent
+	}
+	return a
+}
@@ -0,0 +1,114 @@
+//go:build linux
+
+package main
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// FS_IOC_FIEMAP = _IOWR('f', 11, struct fiemap), computed by hand since
+// it isn't exposed by the standard syscall package.
+const fsIOCFiemap = 0xC020660B
+
+const (
+	fiemapHeaderSize = 32 // sizeof(struct fiemap) minus the flexible fm_extents array
+	fiemapExtentSize = 56 // sizeof(struct fiemap_extent)
+	fiemapPerCall    = 64 // extents requested per ioctl call; fileExtents loops past this rather than truncating
+
+	fiemapExtentLast    = 0x00000001 // FIEMAP_EXTENT_LAST: no more extents after this one
+	fiemapExtentEncoded = 0x00000800 // FIEMAP_EXTENT_ENCODED: extent data is stored compressed/encrypted, so fe_length (logical) overstates what it costs on disk
+)
+
+type fiemapHeader struct {
+	Start         uint64
+	Length        uint64
+	Flags         uint32
+	MappedExtents uint32
+	ExtentCount   uint32
+	Reserved      uint32
+}
+
+type fiemapExtent struct {
+	Logical    uint64
+	Physical   uint64
+	Length     uint64
+	Reserved64 [2]uint64
+	Flags      uint32
+	Reserved   [3]uint32
+}
+
+// fileExtents lists path's physical extents via FS_IOC_FIEMAP, the same
+// ioctl `filefrag` uses, looping the call starting from the last mapped
+// extent's end until the kernel reports FIEMAP_EXTENT_LAST so a
+// fragmented file past fiemapPerCall extents isn't silently truncated.
+// ok is false whenever the ioctl isn't supported at all - not btrfs, not
+// a regular file, an older kernel - and callers should fall back to
+// treating the file as unshared.
+func fileExtents(path string) ([]fileExtent, bool) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, false
+	}
+	defer f.Close()
+
+	buf := make([]byte, fiemapHeaderSize+fiemapPerCall*fiemapExtentSize)
+	var extents []fileExtent
+	start := uint64(0)
+
+	for {
+		header := (*fiemapHeader)(unsafe.Pointer(&buf[0]))
+		*header = fiemapHeader{}
+		header.Start = start
+		header.Length = ^uint64(0)
+		header.ExtentCount = fiemapPerCall
+
+		_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, f.Fd(), fsIOCFiemap, uintptr(unsafe.Pointer(&buf[0])))
+		if errno != 0 {
+			if len(extents) > 0 {
+				return extents, true
+			}
+			return nil, false
+		}
+		if header.MappedExtents == 0 {
+			break
+		}
+
+		var last fiemapExtent
+		for i := uint32(0); i < header.MappedExtents; i++ {
+			raw := (*fiemapExtent)(unsafe.Pointer(&buf[fiemapHeaderSize+int(i)*fiemapExtentSize]))
+			extents = append(extents, fileExtent{
+				physical: raw.Physical,
+				length:   raw.Length,
+				encoded:  raw.Flags&fiemapExtentEncoded != 0,
+			})
+			last = *raw
+		}
+		if last.Flags&fiemapExtentLast != 0 || header.MappedExtents < fiemapPerCall {
+			break
+		}
+		start = last.Logical + last.Length
+	}
+	return extents, true
+}
+
+// subvolumeBoundaryIno is the inode number every btrfs subvolume root
+// (and the top-level btrfs volume itself) uses. It is only meaningful on
+// btrfs - ext4/xfs/etc. hand out 256 as an ordinary inode number - so
+// isSubvolumeRoot must confirm the filesystem itself before trusting it.
+const subvolumeBoundaryIno = 256
+
+const btrfsSuperMagic = 0x9123683e
+
+func isBtrfs(path string) bool {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(path, &st); err != nil {
+		return false
+	}
+	return int64(st.Type) == btrfsSuperMagic
+}
+
+func isSubvolumeRoot(path string, sys *syscall.Stat_t) bool {
+	return sys.Ino == subvolumeBoundaryIno && isBtrfs(path)
+}
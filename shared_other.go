@@ -0,0 +1,15 @@
+//go:build !linux
+
+package main
+
+import "syscall"
+
+// fileExtents is unsupported outside Linux (FIEMAP is a Linux-specific
+// ioctl); -shared-aware falls back to apparent-only accounting.
+func fileExtents(path string) ([]fileExtent, bool) {
+	return nil, false
+}
+
+func isSubvolumeRoot(path string, sys *syscall.Stat_t) bool {
+	return false
+}
@@ -0,0 +1,11 @@
+//go:build darwin
+
+package main
+
+import "syscall"
+
+// statTimes extracts mtime/ctime (seconds) from a platform Stat_t, since
+// the field names differ between Linux (Mtim/Ctim) and macOS (Mtimespec/Ctimespec).
+func statTimes(sys *syscall.Stat_t) (mtime, ctime int64) {
+	return sys.Mtimespec.Sec, sys.Ctimespec.Sec
+}
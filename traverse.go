@@ -0,0 +1,379 @@
+package main
+
+import (
+	"context"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// node is the mutable, pointer-based tree built while walking. It is
+// converted to an immutable summaryNode only once the walk is finished,
+// so concurrent workers never touch a summaryNode directly. parent and
+// remaining let processJob notice, from any worker goroutine, the exact
+// moment a given directory's whole subtree - not just its own entries -
+// has finished, so opts.emit can stream it out without waiting for the
+// rest of the walk.
+type node struct {
+	fullpath    string
+	device      uint64
+	depth       int
+	ownBytes    uint64
+	ownUnique   uint64
+	total       uint64
+	totalUnique uint64
+	children    []*node
+	parent      *node
+
+	mu        sync.Mutex
+	remaining int // starts at 1 for "own scan not yet done"; +1 per child discovered, -1 each time one of those resolves
+}
+
+type walkJob struct {
+	dir    string
+	device uint64
+	parent *node
+}
+
+// walkOptions bundles the -cross/-shared-aware/-cross-subvol knobs so
+// adding one doesn't grow processJob's parameter list again. emit, if
+// set, is called once per node as soon as its whole subtree completes -
+// used to stream ndjson output during the scan instead of only at the
+// very end.
+type walkOptions struct {
+	crossFS     bool
+	sharedAware bool
+	crossSubvol bool
+	extents     *extentTracker
+	emit        func(*node)
+}
+
+// fdLimiter caps the number of directory file descriptors open at once,
+// independent of how many worker goroutines are running - a wide tree
+// with many threads would otherwise open far more fds than necessary.
+type fdLimiter chan struct{}
+
+func newFDLimiter(n int) fdLimiter {
+	if n <= 0 {
+		n = 1
+	}
+	return make(fdLimiter, n)
+}
+
+func (l fdLimiter) acquire() { l <- struct{}{} }
+func (l fdLimiter) release() { <-l }
+
+// latencyThrottle slows workers down once Readdirnames starts taking a
+// long time - the signature of a magnetic disk thrashing under too much
+// concurrent seeking - by tracking an exponential moving average latency.
+type latencyThrottle struct {
+	avgMicros int64
+	mu        sync.Mutex
+}
+
+const slowReaddirMicros = 250 * 1000
+
+func (t *latencyThrottle) record(d time.Duration) {
+	t.mu.Lock()
+	t.avgMicros = (t.avgMicros*7 + d.Microseconds()) / 8
+	t.mu.Unlock()
+}
+
+func (t *latencyThrottle) backoff() time.Duration {
+	t.mu.Lock()
+	avg := t.avgMicros
+	t.mu.Unlock()
+	if avg < slowReaddirMicros {
+		return 0
+	}
+	return time.Duration(avg) * time.Microsecond
+}
+
+// readdir lists dir's directory and regular-file entries, same filtering
+// rules as lStats, but acquires fds before opening the directory and
+// feeds the throttle with how long Readdirnames took. Unlike lStats it
+// does not stop at a filesystem boundary - whether to descend into a
+// child on a different device is processJob's decision, since it alone
+// knows whether -cross was given.
+func readdir(dir string, fds fdLimiter, throttle *latencyThrottle) []os.FileInfo {
+	fds.acquire()
+	defer fds.release()
+
+	f, err := os.Open(dir)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+
+	start := time.Now()
+	names, err := f.Readdirnames(0)
+	throttle.record(time.Since(start))
+	if err != nil {
+		return nil
+	}
+
+	result := make([]os.FileInfo, 0, len(names))
+	for _, name := range names {
+		stat, err := os.Lstat(dir + "/" + name)
+		if err != nil {
+			continue
+		}
+		mode := stat.Mode()
+		if (mode & os.ModeSymlink) != 0 {
+			continue
+		}
+		if mode.IsDir() || mode.IsRegular() {
+			result = append(result, stat)
+		}
+	}
+	return result
+}
+
+// walkTree replaces the old recursive worker/workerThread pair with an
+// explicit (dir, parent) work queue, so a pathologically deep tree
+// cannot blow the goroutine stack. threads bounds how many directories
+// are processed at once; maxOpenDirs independently bounds concurrently
+// open directory fds. Cancelling ctx (Ctrl-C in main) stops handing out
+// new work and returns whatever has been discovered so far. Unless
+// crossFS is set, a subdirectory on a different device than its parent
+// is left unvisited, the same filesystem-boundary behavior as before.
+// emit, if non-nil, is called as soon as each node's whole subtree is
+// done - not just once at the very end - so a streaming reporter (ndjson)
+// can start writing before the rest of the tree finishes.
+func walkTree(ctx context.Context, dir string, device uint64, threads, maxOpenDirs int, crossFS, sharedAware, crossSubvol bool, emit func(*node)) summaryNode {
+	root := &node{fullpath: dir, device: device, remaining: 1}
+	fds := newFDLimiter(maxOpenDirs)
+	throttle := &latencyThrottle{}
+	opts := walkOptions{crossFS: crossFS, sharedAware: sharedAware, crossSubvol: crossSubvol, extents: newExtentTracker(), emit: emit}
+
+	jobs := make(chan walkJob, threads)
+	var pending sync.WaitGroup
+	pending.Add(1)
+	jobs <- walkJob{dir: dir, device: device, parent: root}
+
+	var workers sync.WaitGroup
+	for i := 0; i < threads; i++ {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			for job := range jobs {
+				processJob(ctx, job, jobs, &pending, fds, throttle, opts)
+			}
+		}()
+	}
+
+	// pending only reaches zero once every enqueue goroutine below has
+	// either delivered its job or abandoned it via ctx.Done(), so waiting
+	// on it alone - rather than racing it against ctx.Done() here too -
+	// guarantees no goroutine is still parked in a select that could
+	// land on a send to jobs after it's closed.
+	done := make(chan struct{})
+	go func() {
+		pending.Wait()
+		close(done)
+	}()
+	<-done
+
+	close(jobs)
+	workers.Wait()
+
+	// Only safe once every file in the walk has registered its extents -
+	// an owner settled any earlier could still have been too shallow.
+	opts.extents.resolve()
+	finalizeTotals(root)
+	return toSummaryNode(root)
+}
+
+// processJob reads one directory and attaches its regular-file bytes and
+// subdirectory nodes to job.parent. Discovered subdirectories are handed
+// off in bulk to a single enqueueChildren goroutine rather than one
+// goroutine per subdirectory - a directory with millions of entries
+// would otherwise spawn millions of goroutines all parked on the same
+// send at once, reintroducing the unbounded-memory growth the job-queue
+// design exists to avoid. A subdirectory whose device differs from
+// job's is skipped unless opts.crossFS is set; likewise a btrfs
+// subvolume root is skipped unless opts.crossSubvol is set, since a
+// subvolume is its own accounting boundary much like a mounted
+// filesystem. When opts.sharedAware is set, each regular file's extents
+// are registered with opts.extents instead of being added to ownUnique
+// directly - which node actually gets charged for a shared extent isn't
+// settled until opts.extents.resolve() runs once the whole walk is done
+// - otherwise the unique total simply mirrors the apparent total.
+// job.parent's own scan always counts as one unit of its outstanding
+// work, resolved via the deferred finishOne below whether this job runs
+// to completion or bails out early.
+func processJob(ctx context.Context, job walkJob, jobs chan<- walkJob, pending *sync.WaitGroup, fds fdLimiter, throttle *latencyThrottle, opts walkOptions) {
+	defer pending.Done()
+	defer finishOne(job.parent, opts)
+
+	if ctx.Err() != nil {
+		return
+	}
+	if backoff := throttle.backoff(); backoff > 0 {
+		time.Sleep(backoff)
+	}
+
+	var childJobs []walkJob
+	for _, stat := range readdir(job.dir, fds, throttle) {
+		mode := stat.Mode()
+		sys := stat.Sys().(*syscall.Stat_t)
+		if mode.IsRegular() {
+			apparent := 512 * uint64(sys.Blocks)
+			job.parent.ownBytes += apparent
+			if opts.sharedAware {
+				fullpath := strings.ReplaceAll(job.dir+"/"+stat.Name(), "//", "/")
+				opts.extents.accountFile(fullpath, uint64(sys.Dev), job.parent)
+			} else {
+				job.parent.ownUnique += apparent
+			}
+		} else if mode.IsDir() {
+			childDevice := uint64(sys.Dev)
+			if childDevice != job.device && !opts.crossFS {
+				continue
+			}
+			fullpath := strings.ReplaceAll(job.dir+"/"+stat.Name(), "//", "/")
+			if opts.sharedAware && !opts.crossSubvol && isSubvolumeRoot(fullpath, sys) {
+				continue
+			}
+
+			child := &node{fullpath: fullpath, device: childDevice, parent: job.parent, depth: job.parent.depth + 1, remaining: 1}
+			job.parent.children = append(job.parent.children, child)
+			addChild(job.parent)
+
+			childJobs = append(childJobs, walkJob{dir: fullpath, device: childDevice, parent: child})
+		}
+	}
+
+	if len(childJobs) > 0 {
+		pending.Add(len(childJobs))
+		go enqueueChildren(ctx, childJobs, jobs, pending, opts)
+	}
+}
+
+// enqueueChildren feeds childJobs onto jobs one at a time from a single
+// goroutine, shared across however many subdirectories one processJob
+// call discovered, rather than parking a dedicated goroutine per
+// subdirectory on the same send.
+func enqueueChildren(ctx context.Context, childJobs []walkJob, jobs chan<- walkJob, pending *sync.WaitGroup, opts walkOptions) {
+	for _, childJob := range childJobs {
+		select {
+		case jobs <- childJob:
+			// Picked up; processJob's own deferred pending.Done() fires
+			// once it actually runs for this job.
+		case <-ctx.Done():
+			// Abandoned before a worker ever picked it up, so processJob
+			// will never run for it and never fire its own finishOne; do
+			// so here instead, with whatever (zero) bytes it never got
+			// to scan. This must happen before pending.Done() - same as
+			// processJob's own defer ordering - so pending reaching zero
+			// in walkTree guarantees every finishOne call has already
+			// finished, with no goroutine left that could race
+			// finalizeTotals.
+			finishOne(childJob.parent, opts)
+			pending.Done()
+		}
+	}
+}
+
+// addChild records that parent has one more outstanding child subtree to
+// wait for before parent's own totals are final.
+func addChild(parent *node) {
+	parent.mu.Lock()
+	parent.remaining++
+	parent.mu.Unlock()
+}
+
+// finishOne resolves one unit of n's outstanding work - either n's own
+// scan or one of its children's whole subtrees - and, once nothing is
+// left outstanding, folds n's totals up from its (by then complete)
+// children, emits n via opts.emit, and repeats the same check for n's
+// parent. It walks the parent chain with a loop rather than recursion so
+// a pathologically deep tree can't overflow the stack here either.
+func finishOne(n *node, opts walkOptions) {
+	for n != nil {
+		n.mu.Lock()
+		n.remaining--
+		ready := n.remaining == 0
+		n.mu.Unlock()
+		if !ready {
+			return
+		}
+
+		n.total = n.ownBytes
+		n.totalUnique = n.ownUnique
+		for _, child := range n.children {
+			n.total += child.total
+			n.totalUnique += child.totalUnique
+		}
+		if opts.emit != nil {
+			opts.emit(n)
+		}
+		n = n.parent
+	}
+}
+
+// finalizeTotals computes each node's recursive byte total from the
+// bottom up without recursion: it records discovery order (a parent
+// always precedes its children in a breadth-first walk), then sums in
+// reverse so every child total is known before its parent needs it.
+func finalizeTotals(root *node) {
+	order := []*node{root}
+	for i := 0; i < len(order); i++ {
+		order = append(order, order[i].children...)
+	}
+	for i := len(order) - 1; i >= 0; i-- {
+		n := order[i]
+		n.total = n.ownBytes
+		n.totalUnique = n.ownUnique
+		for _, child := range n.children {
+			n.total += child.total
+			n.totalUnique += child.totalUnique
+		}
+	}
+}
+
+// toSummaryNode converts the pointer-based tree into the summaryNode
+// shape dump() expects, iteratively so conversion itself cannot
+// overflow the stack on a deep tree, applying the same oneGB elision
+// threshold as appendChildNode.
+func toSummaryNode(root *node) summaryNode {
+	result := summaryNode{fullpath: root.fullpath, size: root.total, uniqueSize: root.totalUnique, device: root.device}
+
+	type frame struct {
+		src *node
+		dst *summaryNode
+	}
+	stack := []frame{{root, &result}}
+
+	for len(stack) > 0 {
+		f := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+
+		qualifying := qualifyingChildren(f.src)
+		f.dst.children = make([]summaryNode, len(qualifying))
+		for i, child := range qualifying {
+			f.dst.children[i] = summaryNode{fullpath: child.fullpath, size: child.total, uniqueSize: child.totalUnique, device: child.device}
+			stack = append(stack, frame{child, &f.dst.children[i]})
+		}
+	}
+
+	return result
+}
+
+// qualifyingChildren returns n's children whose total clears oneGB, the
+// same elision threshold appendChildNode applies when building a
+// summaryNode - so anything deriving child_count/elided from a live
+// *node tree (ndjsonEmitter, in particular) agrees with the
+// summaryNode-based reporters instead of counting every subdirectory
+// regardless of size.
+func qualifyingChildren(n *node) []*node {
+	qualifying := make([]*node, 0, len(n.children))
+	for _, child := range n.children {
+		if oneGB < child.total {
+			qualifying = append(qualifying, child)
+		}
+	}
+	return qualifying
+}